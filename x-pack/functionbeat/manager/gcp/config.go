@@ -0,0 +1,56 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package gcp
+
+import "fmt"
+
+// defaultRuntime is used when the user does not select one explicitly.
+const defaultRuntime = "go121"
+
+// supportedRuntimes lists the Cloud Functions runtime identifiers accepted by
+// the `runtime` setting. `go111` is still accepted for backward compatibility
+// but is deprecated in favor of defaultRuntime.
+var supportedRuntimes = map[string]bool{
+	"go111": true, // deprecated, kept for backward compatibility
+	"go113": true,
+	"go116": true,
+	"go119": true,
+	"go121": true,
+}
+
+// Config is the configuration of the GCP provider, shared by every function
+// deployed through Functionbeat.
+type Config struct {
+	ProjectID       string `config:"project_id"`
+	Location        string `config:"location"`
+	FunctionStorage string `config:"function_storage"`
+
+	// Runtime is the Cloud Functions runtime identifier, e.g. "go121".
+	// Defaults to defaultRuntime when unset.
+	Runtime string `config:"runtime"`
+
+	// Secrets configures how `${secret:projects/p/secrets/s/versions/v}`
+	// placeholders in the outer libbeat config are resolved against Google
+	// Secret Manager at deploy time.
+	Secrets SecretsConfig `config:"secrets"`
+}
+
+// SecretsConfig enables resolving Secret Manager placeholders in the
+// Functionbeat configuration before it is deployed.
+type SecretsConfig struct {
+	Enabled bool `config:"enabled"`
+}
+
+// Validate checks that the Runtime field, when set, is one Functionbeat
+// knows how to deploy.
+func (c *Config) Validate() error {
+	if len(c.Runtime) == 0 {
+		return nil
+	}
+	if !supportedRuntimes[c.Runtime] {
+		return fmt.Errorf("unsupported runtime %q", c.Runtime)
+	}
+	return nil
+}
@@ -0,0 +1,393 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package gcp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/api/cloudfunctions/v2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/storage/v1"
+
+	"github.com/elastic/beats/libbeat/common"
+	fngcp "github.com/elastic/beats/x-pack/functionbeat/provider/gcp/gcp"
+)
+
+// Diff describes how the locally rendered template for a function differs
+// from what is currently deployed, so operators can preview churn (env-var
+// changes, memory bumps, trigger swaps, source-hash drift) before running
+// `functionbeat deploy`.
+type Diff struct {
+	FunctionName  string                    `json:"function_name"`
+	Added         common.MapStr             `json:"added,omitempty"`
+	Removed       common.MapStr             `json:"removed,omitempty"`
+	Changed       map[string][2]interface{} `json:"changed,omitempty"`
+	SourceChanged bool                      `json:"source_changed"`
+}
+
+// HasChanges reports whether deploying would change anything about the
+// function.
+func (d Diff) HasChanges() bool {
+	return len(d.Added) > 0 || len(d.Removed) > 0 || len(d.Changed) > 0 || d.SourceChanged
+}
+
+// String renders the diff as a human-readable summary.
+func (d Diff) String() string {
+	if !d.HasChanges() {
+		return fmt.Sprintf("%s: up to date", d.FunctionName)
+	}
+
+	out := fmt.Sprintf("%s:\n", d.FunctionName)
+	for k, v := range d.Added {
+		out += fmt.Sprintf("  + %s: %v\n", k, v)
+	}
+	for k, v := range d.Removed {
+		out += fmt.Sprintf("  - %s: %v\n", k, v)
+	}
+	for k, v := range d.Changed {
+		out += fmt.Sprintf("  ~ %s: %v -> %v\n", k, v[0], v[1])
+	}
+	if d.SourceChanged {
+		out += "  ~ source archive contents differ from the deployed function\n"
+	}
+	return out
+}
+
+// Planner is implemented by template builders that can preview a deploy.
+// A caller reaches Plan by type-asserting a provider's
+// provider.TemplateBuilder against this interface. No `functionbeat`
+// subcommand calls it; there is no `functionbeat plan` command.
+type Planner interface {
+	Plan(name string) (Diff, error)
+}
+
+var _ Planner = (*defaultTemplateBuilder)(nil)
+
+// Plan fetches the live Cloud Function named `name`, normalizes it into the
+// same common.MapStr shape produced by diffBody, and returns the diff
+// against what `deploy` would push. It lets operators preview the effect of
+// a deploy, including a hash comparison of the locally zipped source against
+// the object currently referenced by the function's source archive.
+func (d *defaultTemplateBuilder) Plan(name string) (Diff, error) {
+	fn, err := findFunction(d.provider, name)
+	if err != nil {
+		return Diff{}, err
+	}
+
+	wanted, err := d.diffBody(name, fn.Config())
+	if err != nil {
+		return Diff{}, err
+	}
+
+	ctx := context.Background()
+	svc, err := cloudfunctions.NewService(ctx)
+	if err != nil {
+		return Diff{}, fmt.Errorf("could not create Cloud Functions client: %w", err)
+	}
+
+	fullName := fmt.Sprintf(functionName, d.gcpConfig.ProjectID, d.gcpConfig.Location, name)
+	live, err := svc.Projects.Locations.Functions.Get(fullName).Do()
+	if err != nil {
+		return Diff{}, fmt.Errorf("could not fetch live function %q: %w", fullName, err)
+	}
+
+	current := normalizeLiveFunction(live)
+	diff := diffMapStr(name, current, wanted)
+
+	sourceChanged, err := d.sourceHashChanged(ctx, name)
+	if err != nil {
+		return Diff{}, err
+	}
+	diff.SourceChanged = sourceChanged
+
+	return diff, nil
+}
+
+// normalizeLiveFunction converts the Cloud Functions v2 API response for a
+// live function into the same nested common.MapStr shape produced by
+// diffBody, so it can be diffed directly against what would be deployed. The
+// v2 Get API returns this shape (buildConfig/serviceConfig/eventTrigger) for
+// both gen1 and gen2 functions; there is no flat runtime/sourceArchiveUrl on
+// the message itself.
+func normalizeLiveFunction(fn *cloudfunctions.CloudFunction) common.MapStr {
+	body := common.MapStr{
+		"name":        fn.Name,
+		"description": fn.Description,
+	}
+
+	if bc := fn.BuildConfig; bc != nil {
+		buildConfig := common.MapStr{
+			"runtime":    bc.Runtime,
+			"entryPoint": bc.EntryPoint,
+		}
+		if bc.Source != nil && bc.Source.StorageSource != nil {
+			buildConfig["source"] = common.MapStr{
+				"storageSource": fmt.Sprintf("gs://%s/%s", bc.Source.StorageSource.Bucket, bc.Source.StorageSource.Object),
+			}
+		}
+		body["buildConfig"] = buildConfig
+	}
+
+	if sc := fn.ServiceConfig; sc != nil {
+		serviceConfig := common.MapStr{}
+		if len(sc.EnvironmentVariables) > 0 {
+			env := common.MapStr{}
+			for k, v := range sc.EnvironmentVariables {
+				env[k] = v
+			}
+			serviceConfig["environmentVariables"] = env
+		}
+		if len(sc.SecretEnvironmentVariables) > 0 {
+			secrets := make([]common.MapStr, 0, len(sc.SecretEnvironmentVariables))
+			for _, s := range sc.SecretEnvironmentVariables {
+				secrets = append(secrets, common.MapStr{"key": s.Key, "projectId": s.ProjectId, "secret": s.Secret, "version": s.Version})
+			}
+			serviceConfig["secretEnvironmentVariables"] = secrets
+		}
+		if sc.TimeoutSeconds > 0 {
+			serviceConfig["timeoutSeconds"] = sc.TimeoutSeconds
+		}
+		if sc.AvailableMemory != "" {
+			serviceConfig["availableMemoryMb"] = sc.AvailableMemory
+		}
+		if sc.ServiceAccountEmail != "" {
+			serviceConfig["serviceAccountEmail"] = sc.ServiceAccountEmail
+		}
+		if sc.MaxInstanceCount > 0 {
+			serviceConfig["maxInstanceCount"] = sc.MaxInstanceCount
+		}
+		if sc.VpcConnector != "" {
+			serviceConfig["vpcConnector"] = sc.VpcConnector
+		}
+		body["serviceConfig"] = serviceConfig
+	}
+
+	if et := fn.EventTrigger; et != nil {
+		eventTrigger := common.MapStr{
+			"triggerRegion":       et.TriggerRegion,
+			"eventType":           et.EventType,
+			"serviceAccountEmail": et.ServiceAccountEmail,
+		}
+		if et.PubsubTopic != "" {
+			eventTrigger["pubsubTopic"] = et.PubsubTopic
+		}
+		if et.Channel != "" {
+			eventTrigger["channel"] = et.Channel
+		}
+		if len(et.EventFilters) > 0 {
+			filters := make([]common.MapStr, 0, len(et.EventFilters))
+			for _, f := range et.EventFilters {
+				filter := common.MapStr{"attribute": f.Attribute, "value": f.Value}
+				if f.Operator != "" {
+					filter["operator"] = f.Operator
+				}
+				filters = append(filters, filter)
+			}
+			eventTrigger["eventFilters"] = filters
+		}
+		body["eventTrigger"] = eventTrigger
+	}
+
+	if len(fn.Labels) > 0 {
+		labels := common.MapStr{}
+		for k, v := range fn.Labels {
+			labels[k] = v
+		}
+		body["labels"] = labels
+	}
+
+	return body
+}
+
+// diffMapStr compares the currently deployed request body against the one
+// that would be pushed, producing an added/removed/changed breakdown. It
+// recurses into nested common.MapStr values (buildConfig, serviceConfig,
+// eventTrigger, ...) so a change to a single leaf field, e.g.
+// "serviceConfig.timeoutSeconds", is reported on its own dotted key rather
+// than flagging the whole nested block as added and removed.
+func diffMapStr(name string, current, wanted common.MapStr) Diff {
+	diff := Diff{
+		FunctionName: name,
+		Added:        common.MapStr{},
+		Removed:      common.MapStr{},
+		Changed:      map[string][2]interface{}{},
+	}
+
+	collectDiff("", current, wanted, &diff)
+
+	return diff
+}
+
+func collectDiff(prefix string, current, wanted common.MapStr, diff *Diff) {
+	for k, wantedValue := range wanted {
+		key := dottedKey(prefix, k)
+		currentValue, ok := current[k]
+		if !ok {
+			diff.Added[key] = wantedValue
+			continue
+		}
+
+		wantedNested, wantedIsNested := wantedValue.(common.MapStr)
+		currentNested, currentIsNested := currentValue.(common.MapStr)
+		if wantedIsNested && currentIsNested {
+			collectDiff(key, currentNested, wantedNested, diff)
+			continue
+		}
+
+		if fmt.Sprint(currentValue) != fmt.Sprint(wantedValue) {
+			diff.Changed[key] = [2]interface{}{currentValue, wantedValue}
+		}
+	}
+	for k, currentValue := range current {
+		if _, ok := wanted[k]; !ok {
+			diff.Removed[dottedKey(prefix, k)] = currentValue
+		}
+	}
+}
+
+func dottedKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// diffBody builds the nested buildConfig/serviceConfig/eventTrigger shape
+// normalizeLiveFunction produces from a live function, regardless of which
+// generation will actually be deployed. The Cloud Functions v2 Get API
+// always returns that nested shape, even for gen1 functions, so Plan needs a
+// like-for-like "wanted" view distinct from the flat body requestBodyV1
+// actually POSTs to the legacy v1 API.
+func (d *defaultTemplateBuilder) diffBody(name string, config *fngcp.FunctionConfig) (common.MapStr, error) {
+	if config.Generation == fngcp.GenerationV2 {
+		return d.requestBodyV2(name, config)
+	}
+
+	fnName := fmt.Sprintf(functionName, d.gcpConfig.ProjectID, d.gcpConfig.Location, name)
+	serviceConfig := common.MapStr{
+		"environmentVariables": common.MapStr{
+			"ENABLED_FUNCTIONS": name,
+		},
+	}
+	if config.Timeout > 0*time.Second {
+		serviceConfig["timeoutSeconds"] = int(config.Timeout.Seconds())
+	}
+	if config.MemorySize > 0 {
+		serviceConfig["availableMemoryMb"] = config.MemorySize
+	}
+	if len(config.ServiceAccountEmail) > 0 {
+		serviceConfig["serviceAccountEmail"] = config.ServiceAccountEmail
+	}
+	if config.MaxInstances > 0 {
+		serviceConfig["maxInstanceCount"] = config.MaxInstances
+	}
+	if len(config.VPCConnector) > 0 {
+		serviceConfig["vpcConnector"] = config.VPCConnector
+	}
+	if len(config.SecretEnvironmentVariables) > 0 {
+		serviceConfig["secretEnvironmentVariables"] = secretEnvironmentVariables(config)
+	}
+
+	eventTrigger, err := d.gen1TriggerToEventarc(config)
+	if err != nil {
+		return nil, err
+	}
+
+	body := common.MapStr{
+		"name":        fnName,
+		"description": config.Description,
+		"buildConfig": common.MapStr{
+			"runtime":    d.runtime(),
+			"entryPoint": config.EntryPoint(),
+			"source": common.MapStr{
+				"storageSource": fmt.Sprintf(sourceArchiveURL, d.gcpConfig.FunctionStorage, name),
+			},
+		},
+		"serviceConfig": serviceConfig,
+		"eventTrigger":  eventTrigger,
+	}
+	if len(config.Labels) > 0 {
+		body["labels"] = config.Labels
+	}
+	return body, nil
+}
+
+// gen1TriggerToEventarc translates a gen1 `trigger` block (eventType plus a
+// generic `resource`) into the eventTrigger shape the v2 Get API returns for
+// it, so diffBody's gen1 branch can be diffed directly against
+// normalizeLiveFunction instead of comparing the untranslated gen1 namespace
+// against the gen2 one Google always reports back.
+func (d *defaultTemplateBuilder) gen1TriggerToEventarc(config *fngcp.FunctionConfig) (common.MapStr, error) {
+	rawEventType, _ := config.Trigger["eventType"].(string)
+	eventType, err := translateEventType(rawEventType)
+	if err != nil {
+		return nil, err
+	}
+
+	eventTrigger := common.MapStr{
+		"triggerRegion":       d.gcpConfig.Location,
+		"eventType":           eventType,
+		"serviceAccountEmail": config.ServiceAccountEmail,
+	}
+
+	resource, _ := config.Trigger["resource"].(string)
+	if len(resource) == 0 {
+		return eventTrigger, nil
+	}
+
+	switch {
+	case strings.Contains(eventType, "pubsub"):
+		eventTrigger["pubsubTopic"] = resource
+	case strings.Contains(eventType, "storage"):
+		eventTrigger["eventFilters"] = []common.MapStr{
+			{"attribute": "bucket", "value": resource},
+		}
+	}
+	return eventTrigger, nil
+}
+
+// sourceHashChanged compares the SHA-256 of the function's locally zipped
+// source against the object currently referenced by `sourceArchiveUrl` in
+// GCS, so a no-op code change doesn't show up as a diff.
+func (d *defaultTemplateBuilder) sourceHashChanged(ctx context.Context, name string) (bool, error) {
+	data, err := d.execute(name)
+	if err != nil {
+		return false, err
+	}
+	localHash := sha256.Sum256(data.raw)
+
+	storageSvc, err := storage.NewService(ctx)
+	if err != nil {
+		return false, fmt.Errorf("could not create Cloud Storage client: %w", err)
+	}
+
+	// Same object that sourceArchiveURL points the function at.
+	object := name
+	reader, err := storageSvc.Objects.Get(d.gcpConfig.FunctionStorage, object).Download()
+	if err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			// No object deployed yet, so any local source counts as a change.
+			return true, nil
+		}
+		return false, fmt.Errorf("could not download deployed source %q: %w", object, err)
+	}
+	defer reader.Body.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, reader.Body); err != nil {
+		return false, err
+	}
+
+	return hex.EncodeToString(localHash[:]) != hex.EncodeToString(hasher.Sum(nil)), nil
+}
@@ -0,0 +1,107 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package gcp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/cloudfunctions/v2"
+
+	"github.com/elastic/beats/libbeat/common"
+	fngcp "github.com/elastic/beats/x-pack/functionbeat/provider/gcp/gcp"
+)
+
+func TestDiffMapStrNested(t *testing.T) {
+	current := common.MapStr{
+		"name": "fn",
+		"serviceConfig": common.MapStr{
+			"timeoutSeconds":      60,
+			"serviceAccountEmail": "old@my-project.iam.gserviceaccount.com",
+		},
+		"removedOnly": "gone",
+	}
+	wanted := common.MapStr{
+		"name": "fn",
+		"serviceConfig": common.MapStr{
+			"timeoutSeconds":      120,
+			"serviceAccountEmail": "old@my-project.iam.gserviceaccount.com",
+		},
+		"addedOnly": "new",
+	}
+
+	diff := diffMapStr("fn", current, wanted)
+
+	assert.Equal(t, "new", diff.Added["addedOnly"])
+	assert.Equal(t, "gone", diff.Removed["removedOnly"])
+	assert.Equal(t, [2]interface{}{60, 120}, diff.Changed["serviceConfig.timeoutSeconds"])
+	assert.NotContains(t, diff.Changed, "serviceConfig")
+	assert.True(t, diff.HasChanges())
+}
+
+func TestDiffMapStrNoChanges(t *testing.T) {
+	body := common.MapStr{
+		"name": "fn",
+		"buildConfig": common.MapStr{
+			"runtime": "go121",
+		},
+	}
+
+	diff := diffMapStr("fn", body, body)
+
+	assert.False(t, diff.HasChanges())
+}
+
+func TestNormalizeLiveFunctionV2Shape(t *testing.T) {
+	fn := &cloudfunctions.CloudFunction{
+		Name: "projects/my-project/locations/us-central1/functions/my-fn",
+		BuildConfig: &cloudfunctions.BuildConfig{
+			Runtime:    "go121",
+			EntryPoint: "my-entry",
+		},
+		EventTrigger: &cloudfunctions.EventTrigger{
+			EventType:   "google.cloud.pubsub.topic.v1.messagePublished",
+			PubsubTopic: "projects/my-project/topics/my-topic",
+		},
+	}
+
+	body := normalizeLiveFunction(fn)
+
+	buildConfig, ok := body["buildConfig"].(common.MapStr)
+	assert.True(t, ok)
+	assert.Equal(t, "go121", buildConfig["runtime"])
+	assert.Equal(t, "my-entry", buildConfig["entryPoint"])
+
+	eventTrigger, ok := body["eventTrigger"].(common.MapStr)
+	assert.True(t, ok)
+	assert.Equal(t, "google.cloud.pubsub.topic.v1.messagePublished", eventTrigger["eventType"])
+	assert.NotContains(t, eventTrigger, "resource")
+}
+
+func TestDiffBodyGen1TriggerMatchesNormalizedShape(t *testing.T) {
+	d := &defaultTemplateBuilder{
+		gcpConfig: &Config{ProjectID: "my-project", Location: "us-central1", FunctionStorage: "my-bucket"},
+	}
+	config := &fngcp.FunctionConfig{
+		Description: "my function",
+		Trigger: common.MapStr{
+			"eventType": "google.storage.object.finalize",
+			"resource":  "my-bucket",
+		},
+	}
+
+	body, err := d.diffBody("my-fn", config)
+	assert.NoError(t, err)
+
+	eventTrigger, ok := body["eventTrigger"].(common.MapStr)
+	assert.True(t, ok)
+	assert.Equal(t, "google.cloud.storage.object.v1.finalized", eventTrigger["eventType"])
+	assert.NotContains(t, eventTrigger, "resource")
+
+	filters, ok := eventTrigger["eventFilters"].([]common.MapStr)
+	assert.True(t, ok)
+	assert.Equal(t, "bucket", filters[0]["attribute"])
+	assert.Equal(t, "my-bucket", filters[0]["value"])
+}
@@ -0,0 +1,166 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package gcp
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"cloud.google.com/go/iam"
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	secretmanagerpb "google.golang.org/genproto/googleapis/cloud/secretmanager/v1"
+
+	"github.com/elastic/beats/libbeat/common"
+	fngcp "github.com/elastic/beats/x-pack/functionbeat/provider/gcp/gcp"
+)
+
+// secretAccessorRole is the IAM role a function's service account needs to
+// read secrets at runtime.
+const secretAccessorRole = "roles/secretmanager.secretAccessor"
+
+// secretPlaceholder matches `${secret:<resource name>}` placeholders in the
+// outer libbeat config, e.g. `${secret:projects/p/secrets/s/versions/latest}`.
+var secretPlaceholder = regexp.MustCompile(`\$\{secret:([^}]+)\}`)
+
+// resolveSecrets replaces every `${secret:...}` placeholder in raw with the
+// value of the referenced Secret Manager secret version. It is a no-op when
+// the GCP provider's `secrets.enabled` setting is false. raw is expected to
+// be a single config value, not a serialized document: splicing a secret's
+// raw bytes into a larger blob (e.g. JSON) risks corrupting or injecting
+// into that structure if the secret contains quotes or control characters.
+func resolveSecrets(ctx context.Context, cfg *Config, raw string) (string, error) {
+	if !cfg.Secrets.Enabled || !secretPlaceholder.MatchString(raw) {
+		return raw, nil
+	}
+
+	client, err := secretmanager.NewClient(ctx)
+	if err != nil {
+		return "", fmt.Errorf("could not create Secret Manager client: %w", err)
+	}
+	defer client.Close()
+
+	return resolveSecretsWithClient(ctx, client, raw)
+}
+
+// resolveSecretsWithClient does the placeholder replacement for
+// resolveSecrets and resolveConfigSecrets, taking an already-open client so
+// resolving every string in a config doesn't open one connection per value.
+func resolveSecretsWithClient(ctx context.Context, client *secretmanager.Client, raw string) (string, error) {
+	var resolveErr error
+	resolved := secretPlaceholder.ReplaceAllStringFunc(raw, func(match string) string {
+		if resolveErr != nil {
+			return match
+		}
+		name := secretPlaceholder.FindStringSubmatch(match)[1]
+		resp, err := client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{Name: name})
+		if err != nil {
+			resolveErr = fmt.Errorf("could not resolve secret %q: %w", name, err)
+			return match
+		}
+		return string(resp.Payload.Data)
+	})
+	if resolveErr != nil {
+		return "", resolveErr
+	}
+
+	return resolved, nil
+}
+
+// checkSecretAccess fails fast when serviceAccountEmail is missing the
+// roles/secretmanager.secretAccessor binding on every secret referenced by
+// secretEnvVars, instead of deploying a function that would crash on cold
+// start while trying to read its secrets. It checks the IAM policy of each
+// referenced secret directly, since TestIamPermissions only reports on the
+// caller's own grants, not a third-party service account's.
+func checkSecretAccess(ctx context.Context, serviceAccountEmail string, secretEnvVars []fngcp.SecretEnvironmentVariable) error {
+	client, err := secretmanager.NewClient(ctx)
+	if err != nil {
+		return fmt.Errorf("could not create Secret Manager client: %w", err)
+	}
+	defer client.Close()
+
+	member := "serviceAccount:" + serviceAccountEmail
+	for _, s := range secretEnvVars {
+		resource := fmt.Sprintf("projects/%s/secrets/%s", s.ProjectID, s.Secret)
+		policy, err := client.IAM(resource).Policy(ctx)
+		if err != nil {
+			return fmt.Errorf("could not fetch IAM policy for secret %q: %w", resource, err)
+		}
+
+		if !hasMember(policy.Members(iam.RoleName(secretAccessorRole)), member) {
+			return fmt.Errorf("service account %q is missing %q on secret %q, required to read it at runtime", serviceAccountEmail, secretAccessorRole, resource)
+		}
+	}
+
+	return nil
+}
+
+func hasMember(members []string, member string) bool {
+	for _, m := range members {
+		if m == member {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveConfigSecrets walks cfg's decoded values, resolves any
+// `${secret:...}` placeholders found in string leaves against Secret
+// Manager, and returns a new *common.Config built from the result, so the
+// rest of the GCP provider's configuration (project IDs, env vars, etc.)
+// never has to handle the placeholder syntax itself. Placeholders are
+// resolved value-by-value rather than against a serialized blob, so a
+// secret containing quotes or control characters can't corrupt or inject
+// into the surrounding structure.
+func resolveConfigSecrets(ctx context.Context, gcpCfg *Config, cfg *common.Config) (*common.Config, error) {
+	var raw map[string]interface{}
+	if err := cfg.Unpack(&raw); err != nil {
+		return nil, fmt.Errorf("could not read configuration for secret resolution: %w", err)
+	}
+
+	client, err := secretmanager.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not create Secret Manager client: %w", err)
+	}
+	defer client.Close()
+
+	resolved, err := resolveSecretsInValue(ctx, client, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return common.NewConfigFrom(resolved)
+}
+
+// resolveSecretsInValue recurses into the maps and slices produced by
+// unpacking a *common.Config into a map[string]interface{}, resolving
+// `${secret:...}` placeholders found in string leaves in place.
+func resolveSecretsInValue(ctx context.Context, client *secretmanager.Client, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return resolveSecretsWithClient(ctx, client, v)
+	case map[string]interface{}:
+		for key, item := range v {
+			resolvedItem, err := resolveSecretsInValue(ctx, client, item)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = resolvedItem
+		}
+		return v, nil
+	case []interface{}:
+		for i, item := range v {
+			resolvedItem, err := resolveSecretsInValue(ctx, client, item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = resolvedItem
+		}
+		return v, nil
+	default:
+		return value, nil
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package gcp
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveSecretsDisabled(t *testing.T) {
+	cfg := &Config{Secrets: SecretsConfig{Enabled: false}}
+	raw := `{"project_id":"my-project","trigger":"${secret:projects/p/secrets/s/versions/latest}"}`
+
+	resolved, err := resolveSecrets(context.Background(), cfg, raw)
+
+	assert.NoError(t, err)
+	assert.Equal(t, raw, resolved)
+}
+
+func TestResolveSecretsNoPlaceholder(t *testing.T) {
+	cfg := &Config{Secrets: SecretsConfig{Enabled: true}}
+	raw := `{"project_id":"my-project"}`
+
+	resolved, err := resolveSecrets(context.Background(), cfg, raw)
+
+	assert.NoError(t, err)
+	assert.Equal(t, raw, resolved)
+}
+
+func TestSecretPlaceholderPattern(t *testing.T) {
+	match := secretPlaceholder.FindStringSubmatch("${secret:projects/p/secrets/s/versions/latest}")
+	assert.Len(t, match, 2)
+	assert.Equal(t, "projects/p/secrets/s/versions/latest", match[1])
+}
+
+// TestResolveSecretsInValuePreservesSpecialChars guards against regressing
+// to resolving placeholders against a serialized (e.g. JSON) blob: with no
+// placeholder present in any leaf, the nil client is never dereferenced,
+// and values containing quotes/backslashes/newlines come back untouched
+// instead of being re-encoded.
+func TestResolveSecretsInValuePreservesSpecialChars(t *testing.T) {
+	raw := map[string]interface{}{
+		"description": `contains "quotes", \backslashes\ and a newline` + "\n",
+		"nested": map[string]interface{}{
+			"list": []interface{}{"a", `b"c`},
+		},
+	}
+
+	resolved, err := resolveSecretsInValue(context.Background(), nil, raw)
+
+	assert.NoError(t, err)
+	assert.Equal(t, raw, resolved)
+}
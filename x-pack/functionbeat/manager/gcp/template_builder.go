@@ -5,9 +5,12 @@
 package gcp
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"os"
 	"path/filepath"
+	"regexp"
 	"time"
 
 	"github.com/elastic/beats/libbeat/common"
@@ -19,10 +22,9 @@ import (
 )
 
 const (
-	runtime          = "go111"                            // Golang 1.11
 	sourceArchiveURL = "gs://%s/%s"                       // path to the function archive
 	locationTemplate = "projects/%s/locations/%s"         // full name of the location
-	functionName     = locationTemplate + "/functions/%s" // full name of the functions
+	functionName     = locationTemplate + "/functions/%s" // full name of the functions, shared by gen1 and gen2
 )
 
 // defaultTemplateBuilder builds request object when deploying Functionbeat using
@@ -46,9 +48,62 @@ func NewTemplateBuilder(log *logp.Logger, cfg *common.Config, p provider.Provide
 		return &defaultTemplateBuilder{}, err
 	}
 
+	if gcpCfg.Secrets.Enabled {
+		resolved, err := resolveConfigSecrets(context.Background(), gcpCfg, cfg)
+		if err != nil {
+			return &defaultTemplateBuilder{}, err
+		}
+		if err := resolved.Unpack(gcpCfg); err != nil {
+			return &defaultTemplateBuilder{}, err
+		}
+		cfg = resolved
+	}
+
+	if err := validateFunctions(context.Background(), p); err != nil {
+		return &defaultTemplateBuilder{}, err
+	}
+
 	return &defaultTemplateBuilder{log: log, gcpConfig: gcpCfg, provider: p}, nil
 }
 
+// validateFunctions refuses to build a template when a gen2 function sets the
+// gen1-only `trigger.resource` field or sets none of pubsub_topic, channel
+// and event_filters, or when a function with an explicit
+// service_account_email reads secretEnvironmentVariables that account is not
+// allowed to access. Functions without service_account_email are not checked
+// for secret access.
+func validateFunctions(ctx context.Context, p provider.Provider) error {
+	functions, err := provider.ListFunctions("gcp")
+	if err != nil {
+		return nil
+	}
+
+	for _, name := range functions {
+		fn, err := findFunction(p, name)
+		if err != nil {
+			continue
+		}
+
+		config := fn.Config()
+		if config.Generation == fngcp.GenerationV2 {
+			if _, ok := config.Trigger["resource"]; ok {
+				return fmt.Errorf("function %q: %q is a gen1-only trigger field and cannot be used with generation: gen2", name, "resource")
+			}
+			if len(config.PubsubTopic) == 0 && len(config.Channel) == 0 && len(config.EventFilters) == 0 {
+				return fmt.Errorf("function %q: generation: gen2 requires pubsub_topic, channel, or event_filters to select the Eventarc source, in addition to trigger.eventType", name)
+			}
+		}
+
+		if len(config.SecretEnvironmentVariables) > 0 && len(config.ServiceAccountEmail) > 0 {
+			if err := checkSecretAccess(ctx, config.ServiceAccountEmail, config.SecretEnvironmentVariables); err != nil {
+				return fmt.Errorf("function %q: %w", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
 func (d *defaultTemplateBuilder) execute(name string) (*functionData, error) {
 	d.log.Debug("Compressing all assets into an artifact")
 
@@ -57,7 +112,10 @@ func (d *defaultTemplateBuilder) execute(name string) (*functionData, error) {
 		return nil, err
 	}
 
-	resources := zipResources(fn.Name())
+	resources, err := zipResources(fn.Name(), fn.Config().Generation)
+	if err != nil {
+		return nil, err
+	}
 	raw, err := core.MakeZip(resources)
 	if err != nil {
 		return nil, err
@@ -65,9 +123,14 @@ func (d *defaultTemplateBuilder) execute(name string) (*functionData, error) {
 
 	d.log.Debugf("Compression is successful (zip size: %d bytes)", len(raw))
 
+	body, err := d.requestBody(name, fn.Config())
+	if err != nil {
+		return nil, err
+	}
+
 	return &functionData{
 		raw:         raw,
-		requestBody: d.requestBody(name, fn.Config()),
+		requestBody: body,
 	}, nil
 }
 
@@ -85,13 +148,22 @@ func findFunction(p provider.Provider, name string) (installer, error) {
 	return function, nil
 }
 
-func (d *defaultTemplateBuilder) requestBody(name string, config *fngcp.FunctionConfig) common.MapStr {
+func (d *defaultTemplateBuilder) requestBody(name string, config *fngcp.FunctionConfig) (common.MapStr, error) {
+	if config.Generation == fngcp.GenerationV2 {
+		return d.requestBodyV2(name, config)
+	}
+	return d.requestBodyV1(name, config), nil
+}
+
+// requestBodyV1 builds the request body for the 1st generation Cloud
+// Functions API, triggered through the legacy `eventTrigger` block.
+func (d *defaultTemplateBuilder) requestBodyV1(name string, config *fngcp.FunctionConfig) common.MapStr {
 	fnName := fmt.Sprintf(functionName, d.gcpConfig.ProjectID, d.gcpConfig.Location, name)
 	body := common.MapStr{
 		"name":             fnName,
 		"description":      config.Description,
 		"entryPoint":       config.EntryPoint(),
-		"runtime":          runtime,
+		"runtime":          d.runtime(),
 		"sourceArchiveUrl": fmt.Sprintf(sourceArchiveURL, d.gcpConfig.FunctionStorage, name),
 		"eventTrigger":     config.Trigger,
 		"environmentVariables": common.MapStr{
@@ -116,9 +188,160 @@ func (d *defaultTemplateBuilder) requestBody(name string, config *fngcp.Function
 	if len(config.VPCConnector) > 0 {
 		body["vpcConnector"] = config.VPCConnector
 	}
+	if len(config.SecretEnvironmentVariables) > 0 {
+		body["secretEnvironmentVariables"] = secretEnvironmentVariables(config)
+	}
 	return body
 }
 
+// secretEnvironmentVariables translates config.SecretEnvironmentVariables
+// into the `secretEnvironmentVariables` block understood by the Cloud
+// Functions API.
+func secretEnvironmentVariables(config *fngcp.FunctionConfig) []common.MapStr {
+	secrets := make([]common.MapStr, 0, len(config.SecretEnvironmentVariables))
+	for _, s := range config.SecretEnvironmentVariables {
+		secrets = append(secrets, common.MapStr{
+			"key":       s.Key,
+			"projectId": s.ProjectID,
+			"secret":    s.Secret,
+			"version":   s.Version,
+		})
+	}
+	return secrets
+}
+
+// requestBodyV2 builds the request body for the 2nd generation Cloud
+// Functions API. Source and runtime configuration move under `buildConfig`,
+// resource sizing and networking move under `serviceConfig`, and events are
+// delivered as CloudEvents through an Eventarc `eventTrigger`.
+func (d *defaultTemplateBuilder) requestBodyV2(name string, config *fngcp.FunctionConfig) (common.MapStr, error) {
+	fnName := fmt.Sprintf(functionName, d.gcpConfig.ProjectID, d.gcpConfig.Location, name)
+
+	serviceConfig := common.MapStr{
+		"environmentVariables": common.MapStr{
+			"ENABLED_FUNCTIONS": name,
+		},
+	}
+	if config.Timeout > 0*time.Second {
+		serviceConfig["timeoutSeconds"] = int(config.Timeout.Seconds())
+	}
+	if config.MemorySize > 0 {
+		serviceConfig["availableMemoryMb"] = config.MemorySize
+	}
+	if len(config.ServiceAccountEmail) > 0 {
+		serviceConfig["serviceAccountEmail"] = config.ServiceAccountEmail
+	}
+	if config.MaxInstances > 0 {
+		serviceConfig["maxInstanceCount"] = config.MaxInstances
+	}
+	if len(config.VPCConnector) > 0 {
+		serviceConfig["vpcConnector"] = config.VPCConnector
+	}
+	if len(config.SecretEnvironmentVariables) > 0 {
+		serviceConfig["secretEnvironmentVariables"] = secretEnvironmentVariables(config)
+	}
+
+	eventTrigger, err := d.eventTriggerV2(config)
+	if err != nil {
+		return nil, err
+	}
+
+	body := common.MapStr{
+		"name":        fnName,
+		"description": config.Description,
+		"buildConfig": common.MapStr{
+			"runtime":    d.runtime(),
+			"entryPoint": config.EntryPoint(),
+			"source": common.MapStr{
+				"storageSource": fmt.Sprintf(sourceArchiveURL, d.gcpConfig.FunctionStorage, name),
+			},
+		},
+		"serviceConfig": serviceConfig,
+		"eventTrigger":  eventTrigger,
+	}
+	if len(config.Labels) > 0 {
+		body["labels"] = config.Labels
+	}
+	return body, nil
+}
+
+// gen1EventTypeToGen2 maps legacy gen1 `eventTrigger.eventType` values to the
+// CloudEvents eventType expected by a gen2 Eventarc trigger.
+var gen1EventTypeToGen2 = map[string]string{
+	"google.storage.object.finalize":       "google.cloud.storage.object.v1.finalized",
+	"google.storage.object.delete":         "google.cloud.storage.object.v1.deleted",
+	"google.storage.object.archive":        "google.cloud.storage.object.v1.archived",
+	"google.storage.object.metadataUpdate": "google.cloud.storage.object.v1.metadataUpdated",
+	"google.pubsub.topic.publish":          "google.cloud.pubsub.topic.v1.messagePublished",
+}
+
+// gen2EventTypePattern matches an eventType already expressed in the gen2
+// CloudEvents namespace, e.g. "google.cloud.pubsub.topic.v1.messagePublished".
+var gen2EventTypePattern = regexp.MustCompile(`^google\.cloud\.[a-z0-9]+(\.[a-z0-9]+)*\.v\d+\.[a-zA-Z]+$`)
+
+// translateEventType maps a user-supplied gen1 eventType into its gen2
+// CloudEvents equivalent, passing through values already expressed in the
+// gen2 namespace, and failing fast on anything it doesn't recognize.
+func translateEventType(eventType string) (string, error) {
+	if v2, ok := gen1EventTypeToGen2[eventType]; ok {
+		return v2, nil
+	}
+	if gen2EventTypePattern.MatchString(eventType) {
+		return eventType, nil
+	}
+	return "", fmt.Errorf("eventType %q has no known generation: gen2 CloudEvents equivalent", eventType)
+}
+
+// eventTriggerV2 translates the GCP trigger configuration into the Eventarc
+// `eventTrigger` block expected by the gen2 Cloud Functions API.
+func (d *defaultTemplateBuilder) eventTriggerV2(config *fngcp.FunctionConfig) (common.MapStr, error) {
+	rawEventType, _ := config.Trigger["eventType"].(string)
+	eventType, err := translateEventType(rawEventType)
+	if err != nil {
+		return nil, err
+	}
+
+	trigger := common.MapStr{
+		"triggerRegion":       d.gcpConfig.Location,
+		"eventType":           eventType,
+		"serviceAccountEmail": config.ServiceAccountEmail,
+	}
+	if len(config.PubsubTopic) > 0 {
+		trigger["pubsubTopic"] = config.PubsubTopic
+	}
+	if len(config.Channel) > 0 {
+		trigger["channel"] = config.Channel
+	}
+	if len(config.EventFilters) > 0 {
+		filters := make([]common.MapStr, 0, len(config.EventFilters))
+		for _, f := range config.EventFilters {
+			filter := common.MapStr{
+				"attribute": f.Attribute,
+				"value":     f.Value,
+			}
+			if len(f.Operator) > 0 {
+				filter["operator"] = f.Operator
+			}
+			filters = append(filters, filter)
+		}
+		trigger["eventFilters"] = filters
+	}
+	return trigger, nil
+}
+
+// runtime returns the Cloud Functions runtime to deploy, falling back to
+// defaultRuntime when the user hasn't selected one and warning when the
+// deprecated `go111` runtime is requested explicitly.
+func (d *defaultTemplateBuilder) runtime() string {
+	if len(d.gcpConfig.Runtime) == 0 {
+		return defaultRuntime
+	}
+	if d.gcpConfig.Runtime == "go111" {
+		d.log.Warn("runtime \"go111\" is deprecated by Google Cloud, please upgrade to \"" + defaultRuntime + "\" or newer")
+	}
+	return d.gcpConfig.Runtime
+}
+
 // RawTemplate returns the JSON to POST to the endpoint.
 func (d *defaultTemplateBuilder) RawTemplate(name string) (string, error) {
 	// TODO output in YAML
@@ -126,7 +349,11 @@ func (d *defaultTemplateBuilder) RawTemplate(name string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	return d.requestBody(name, fn.Config()).StringToPrint(), nil
+	body, err := d.requestBody(name, fn.Config())
+	if err != nil {
+		return "", err
+	}
+	return body.StringToPrint(), nil
 }
 
 // ZipResources returns the list of zip resources
@@ -138,15 +365,114 @@ func ZipResources() []bundle.Resource {
 
 	resources := make([]bundle.Resource, 0)
 	for _, f := range functions {
-		resources = append(resources, zipResources(f)...)
+		fnResources, err := zipResources(f, fngcp.GenerationV1)
+		if err != nil {
+			continue
+		}
+		resources = append(resources, fnResources...)
 	}
 	return resources
 }
 
-func zipResources(typeName string) []bundle.Resource {
-	return []bundle.Resource{
-		&bundle.LocalFile{Path: filepath.Join("pkg", typeName, typeName+".go"), FileMode: 0755},
-		&bundle.LocalFile{Path: filepath.Join("pkg", typeName, "go.mod"), FileMode: 0655},
-		&bundle.LocalFile{Path: filepath.Join("pkg", typeName, "go.sum"), FileMode: 0655},
+// zipResources lists the local files to bundle for a given function. It
+// adapts to the source layout actually present on disk: a single
+// `{name}.go` file, a `main.go`/`function.go` entry point, a vendored
+// `vendor/` tree, or a `go.work` workspace file. When `generation` is
+// GenerationV2 and no entry point exists yet, it scaffolds one with the
+// `cloudevents.Event` handler signature gen2 functions receive, instead of
+// leaving the user to discover the contract themselves.
+func zipResources(typeName string, generation fngcp.Generation) ([]bundle.Resource, error) {
+	dir := filepath.Join("pkg", typeName)
+	resources := []bundle.Resource{
+		&bundle.LocalFile{Path: filepath.Join(dir, "go.mod"), FileMode: 0655},
+		&bundle.LocalFile{Path: filepath.Join(dir, "go.sum"), FileMode: 0655},
 	}
+
+	entryPoint := typeName + ".go"
+	found := false
+	for _, candidate := range []string{typeName + ".go", "main.go", "function.go"} {
+		if fileExists(filepath.Join(dir, candidate)) {
+			entryPoint = candidate
+			found = true
+			break
+		}
+	}
+	entryPath := filepath.Join(dir, entryPoint)
+	if !found && generation == fngcp.GenerationV2 {
+		if err := scaffoldGen2Handler(entryPath); err != nil {
+			return nil, fmt.Errorf("could not scaffold gen2 handler %q: %w", entryPath, err)
+		}
+	}
+	resources = append(resources, &bundle.LocalFile{Path: entryPath, FileMode: 0755})
+
+	if fileExists(filepath.Join(dir, "go.work")) {
+		resources = append(resources, &bundle.LocalFile{Path: filepath.Join(dir, "go.work"), FileMode: 0655})
+	}
+	if vendorDir := filepath.Join(dir, "vendor"); dirExists(vendorDir) {
+		resources = append(resources, vendorResources(vendorDir)...)
+	}
+
+	return resources, nil
+}
+
+// gen2HandlerTemplate is the starter `Run` entry point scaffolded for a new
+// gen2 function. Unlike gen1, the Cloud Functions buildpack generates its
+// own `main` package and refuses user code that declares one, so the
+// handler lives in a plain package and registers itself with
+// functions-framework-go under the name `entryPoint` deploys with.
+const gen2HandlerTemplate = `// Code generated by functionbeat on first deploy. Edit the body, but keep
+// the cloudevents.Event signature: gen2 functions receive CloudEvents
+// through Eventarc instead of the raw GCS/PubSub structs gen1 functions get.
+package function
+
+import (
+	"context"
+
+	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+)
+
+func init() {
+	functions.CloudEvent("Run", Run)
+}
+
+// Run is invoked for every CloudEvent delivered through the gen2 Eventarc
+// trigger.
+func Run(ctx context.Context, event cloudevents.Event) error {
+	return nil
+}
+`
+
+// scaffoldGen2Handler writes gen2HandlerTemplate to path, creating its parent
+// directory if needed, so a new gen2 function has an entry point to edit
+// instead of failing to zip at all.
+func scaffoldGen2Handler(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(gen2HandlerTemplate), 0644)
+}
+
+// vendorResources walks a vendored dependency tree and returns one
+// bundle.LocalFile per regular file found under it.
+func vendorResources(vendorDir string) []bundle.Resource {
+	var resources []bundle.Resource
+	filepath.Walk(vendorDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		resources = append(resources, &bundle.LocalFile{Path: path, FileMode: 0655})
+		return nil
+	})
+	return resources
+}
+
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
 }
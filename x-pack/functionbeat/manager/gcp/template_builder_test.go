@@ -0,0 +1,115 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package gcp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/x-pack/functionbeat/manager/core/bundle"
+	fngcp "github.com/elastic/beats/x-pack/functionbeat/provider/gcp/gcp"
+)
+
+func TestRequestBodyV1(t *testing.T) {
+	d := &defaultTemplateBuilder{
+		gcpConfig: &Config{ProjectID: "my-project", Location: "us-central1", FunctionStorage: "my-bucket"},
+	}
+	config := &fngcp.FunctionConfig{
+		Description: "my function",
+		Trigger:     common.MapStr{"eventType": "google.storage.object.finalize"},
+	}
+
+	body, err := d.requestBody("my-fn", config)
+	assert.NoError(t, err)
+
+	assert.Equal(t, "projects/my-project/locations/us-central1/functions/my-fn", body["name"])
+	assert.Equal(t, defaultRuntime, body["runtime"])
+	assert.Equal(t, config.Trigger, body["eventTrigger"])
+	assert.NotContains(t, body, "buildConfig")
+}
+
+func TestRequestBodyV2(t *testing.T) {
+	d := &defaultTemplateBuilder{
+		gcpConfig: &Config{ProjectID: "my-project", Location: "us-central1", FunctionStorage: "my-bucket"},
+	}
+	config := &fngcp.FunctionConfig{
+		Description:         "my function",
+		Generation:          fngcp.GenerationV2,
+		ServiceAccountEmail: "fn@my-project.iam.gserviceaccount.com",
+		PubsubTopic:         "projects/my-project/topics/my-topic",
+		Trigger:             common.MapStr{"eventType": "google.cloud.pubsub.topic.v1.messagePublished"},
+		EventFilters: []fngcp.EventFilter{
+			{Attribute: "type", Value: "google.cloud.pubsub.topic.v1.messagePublished"},
+		},
+	}
+
+	body, err := d.requestBody("my-fn", config)
+	assert.NoError(t, err)
+
+	buildConfig, ok := body["buildConfig"].(common.MapStr)
+	assert.True(t, ok)
+	assert.Equal(t, defaultRuntime, buildConfig["runtime"])
+
+	eventTrigger, ok := body["eventTrigger"].(common.MapStr)
+	assert.True(t, ok)
+	assert.Equal(t, config.PubsubTopic, eventTrigger["pubsubTopic"])
+	assert.Equal(t, "google.cloud.pubsub.topic.v1.messagePublished", eventTrigger["eventType"])
+	assert.Len(t, eventTrigger["eventFilters"], 1)
+
+	assert.NotContains(t, body, "sourceArchiveUrl")
+}
+
+func TestTranslateEventType(t *testing.T) {
+	v2, err := translateEventType("google.storage.object.finalize")
+	assert.NoError(t, err)
+	assert.Equal(t, "google.cloud.storage.object.v1.finalized", v2)
+
+	v2, err = translateEventType("google.cloud.pubsub.topic.v1.messagePublished")
+	assert.NoError(t, err)
+	assert.Equal(t, "google.cloud.pubsub.topic.v1.messagePublished", v2)
+
+	_, err = translateEventType("not.a.known.event.type")
+	assert.Error(t, err)
+}
+
+func TestZipResourcesScaffoldsGen2Handler(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	resources, err := zipResources("my-fn", fngcp.GenerationV2)
+	assert.NoError(t, err)
+
+	entryPath := filepath.Join("pkg", "my-fn", "my-fn.go")
+	found := false
+	for _, r := range resources {
+		if lf, ok := r.(*bundle.LocalFile); ok && lf.Path == entryPath {
+			found = true
+		}
+	}
+	assert.True(t, found, "expected scaffolded entry point %q among zip resources", entryPath)
+
+	content, err := os.ReadFile(entryPath)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "cloudevents.Event")
+}
+
+func TestRuntime(t *testing.T) {
+	d := &defaultTemplateBuilder{log: logp.NewLogger("test"), gcpConfig: &Config{}}
+	assert.Equal(t, defaultRuntime, d.runtime())
+
+	d.gcpConfig.Runtime = "go119"
+	assert.Equal(t, "go119", d.runtime())
+
+	d.gcpConfig.Runtime = "go111"
+	assert.Equal(t, "go111", d.runtime())
+}
@@ -0,0 +1,82 @@
+// Copyright Elasticsearch B.V. and/or licensed to Elasticsearch B.V. under one
+// or more contributor license agreements. Licensed under the Elastic License;
+// you may not use this file except in compliance with the Elastic License.
+
+package gcp
+
+import (
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// Generation identifies which Cloud Functions API generation a function
+// targets. Functions default to GenerationV1 when unset.
+type Generation string
+
+const (
+	// GenerationV1 targets the 1st generation Cloud Functions API.
+	GenerationV1 Generation = "gen1"
+	// GenerationV2 targets the 2nd generation Cloud Functions API, whose
+	// events are delivered through Eventarc as CloudEvents.
+	GenerationV2 Generation = "gen2"
+)
+
+// EventFilter narrows a gen2 Eventarc trigger down to a subset of the
+// CloudEvents it receives, for example matching a specific Pub/Sub attribute
+// or Storage bucket.
+type EventFilter struct {
+	Attribute string `config:"attribute"`
+	Value     string `config:"value"`
+	Operator  string `config:"operator"` // e.g. "match-path-pattern", empty means exact match
+}
+
+// FunctionConfig is the configuration of a single Google Cloud Function,
+// shared by every GCP trigger type (PubSub, Storage, HTTP, ...).
+type FunctionConfig struct {
+	Description         string        `config:"description"`
+	Timeout             time.Duration `config:"timeout"`
+	MemorySize          int           `config:"memory_size"`
+	MaxInstances        int           `config:"max_instances"`
+	ServiceAccountEmail string        `config:"service_account_email"`
+	VPCConnector        string        `config:"vpc_connector"`
+	Labels              common.MapStr `config:"labels"`
+	Trigger             common.MapStr `config:"trigger"`
+
+	// Generation selects between the 1st and 2nd gen Cloud Functions API.
+	// Defaults to GenerationV1 when empty.
+	Generation Generation `config:"generation"`
+
+	// EventFilters narrows a gen2 eventTrigger to a subset of CloudEvents,
+	// only valid when Generation is GenerationV2.
+	EventFilters []EventFilter `config:"event_filters"`
+
+	// PubsubTopic is the full resource name of the Pub/Sub topic backing a
+	// gen2 eventTrigger, required when the event source is Pub/Sub.
+	PubsubTopic string `config:"pubsub_topic"`
+
+	// Channel is the Eventarc channel used to receive third-party events.
+	// Only valid for gen2 functions.
+	Channel string `config:"channel"`
+
+	// SecretEnvironmentVariables exposes Google Secret Manager secrets to the
+	// function as environment variables, so sensitive values (Elasticsearch
+	// API keys, cloud auth) never need to be baked into the template in
+	// cleartext.
+	SecretEnvironmentVariables []SecretEnvironmentVariable `config:"secret_environment_variables"`
+}
+
+// SecretEnvironmentVariable references a single version of a Secret Manager
+// secret to expose as an environment variable named Key.
+type SecretEnvironmentVariable struct {
+	Key       string `config:"key"`
+	ProjectID string `config:"project_id"`
+	Secret    string `config:"secret"`
+	Version   string `config:"version"`
+}
+
+// EntryPoint returns the name of the exported Go function that Cloud
+// Functions will invoke.
+func (c *FunctionConfig) EntryPoint() string {
+	return "Run"
+}